@@ -0,0 +1,70 @@
+import json
+import os
+
+def jsonKind(value) -> str:
+    """ Returns which kind of JSON value the given value is, treating ints and
+        floats alike."""
+    if isinstance(value, bool):
+        return 'boolean'
+    elif isinstance(value, (int, float)):
+        return 'number'
+    elif isinstance(value, list):
+        return 'list'
+    elif isinstance(value, dict):
+        return 'object'
+    return type(value).__name__
+
+class Config(dict):
+    """ The contents of config.json, where any key in the file can be
+        overridden by an environment variable named GARGAMEL_ followed by the
+        key in upper case (e.g. GARGAMEL_DELETE_DELAY or GARGAMEL_PIPEPORT).
+        The precedence is environment variable, then config.json, then the
+        default given to get. Keys missing from config.json can't be
+        overridden, since there is no value in the file to say what type they
+        should have; config.example.json lists every key."""
+
+    def parseEnv(self, key: str, envValue: str):
+        """ Converts the environment value overriding key. Values overriding a
+            string are used as-is, values overriding a list may also be comma
+            separated, and anything else must be JSON of the same kind as the
+            value in config.json, otherwise a ValueError is raised."""
+        name = 'GARGAMEL_' + key.upper()
+        fileValue = dict.get(self, key)
+        if isinstance(fileValue, str):
+            return envValue
+        try:
+            parsed = json.loads(envValue)
+        except ValueError:
+            if isinstance(fileValue, list):
+                return [item.strip() for item in envValue.split(',') 
+                    if item.strip()]
+            raise ValueError(f"{name} must be JSON, got {envValue!r}")
+        if jsonKind(parsed) != jsonKind(fileValue):
+            raise ValueError(f"{name} must be a {jsonKind(fileValue)} like "
+                f"the value in config.json, got {envValue!r}")
+        return parsed
+
+    def get(self, key: str, default = None):
+        """ Returns the value for key, checking the environment first."""
+        if key not in self:
+            return default
+        envValue = os.environ.get('GARGAMEL_' + key.upper())
+        if envValue == None:
+            return dict.get(self, key)
+        return self.parseEnv(key, envValue)
+
+def loadConfig(path: str = "config.json") -> Config:
+    """ Loads config.json and checks every environment override up front, so
+        a bad value fails at startup rather than wherever the key is first
+        used."""
+    with open(path) as configFile:
+        config = Config(json.load(configFile))
+    names = {}
+    for key in config:
+        names['GARGAMEL_' + key.upper()] = key
+    for name in os.environ:
+        if name.startswith('GARGAMEL_') and name not in names:
+            print(f"Ignoring {name}: there is no matching key in {path}")
+        elif name in names:
+            config.parseEnv(names[name], os.environ[name])
+    return config
@@ -1,10 +1,9 @@
 from steam.client import SteamClient
 from dota2.client import Dota2Client
-import json
+import Config
 
 
-with open("config.json") as configFile:
-    config: dict = json.load(configFile)
+config = Config.loadConfig()
 
 steamClient = SteamClient()
 dotaClient = Dota2Client(steamClient)
@@ -19,7 +18,9 @@ def do_dota_stuff():
     print('Launched DotA')
 
     
-result = steamClient.login(username = config.get('username'), 
+# cli_login prompts on stdin for a Steam Guard email or mobile code when the
+# account asks for one, instead of the login failing silently
+result = steamClient.cli_login(username = config.get('username'), 
                   password = config.get('password'))
-steamClient.run_forever()
-print(result)
\ No newline at end of file
+print(result)
+steamClient.run_forever()
\ No newline at end of file
@@ -7,28 +7,35 @@ from discord.message import Message
 from discord.user import User
 import re
 import math
-import json
 import sqlite3
 import socketserver
 import threading
 import TheCoordinator as TC
+import Config
+import RatingsClient as RC
 import asyncio
 
 class Master_Bot:
 
     def __init__(self):
-        with open("config.json") as configFile:
-            self.config: dict = json.load(configFile)
+        self.config: Config.Config = Config.loadConfig()
 
         eventLoop = asyncio.new_event_loop()
         self.coordinator: TC.Coordinator = TC.Coordinator(eventLoop)
 
-        self.con = sqlite3.connect('allUsers.db')
+        self.con = sqlite3.connect(self.config.get('DB_PATH', 'allUsers.db'))
         intents = discord.Intents.default()
         intents.members = True
         self.client = discord.Client(intents = intents, 
             loop=eventLoop)
         self.theGuild: Guild = None
+        self.ratingsClient: RC.RatingsClient = None
+        if self.config.get('RATINGS_URL'):
+            self.ratingsClient = RC.RatingsClient(
+                self.config.get('RATINGS_URL'), 
+                self.config.get('RATINGS_TTL', 3600),
+                self.config.get('RATINGS_NEGATIVE_TTL', 60),
+                self.config.get('RATINGS_TIMEOUT', 5))
 
         self.deleteMessage = ("\nThis message and your message will be deleted "
             "in {time} seconds.").format(time = self.config.get('DELETE_DELAY'))
@@ -71,7 +78,15 @@ class Master_Bot:
             target=self.socketPipe.serve_forever)
         self.serverThread.start()
         
-        self.client.run(self.config.get('CLIENT_KEY'))
+        # client.run returns once the bot has been stopped (SIGINT or SIGTERM)
+        # and raises if it can't log in or loses the network; either way, stop
+        # taking signups from the webserver so the process can exit
+        try:
+            self.client.run(self.config.get('CLIENT_KEY'))
+        finally:
+            self.socketPipe.shutdown()
+            self.socketPipe.server_close()
+            self.con.close()
 
     def escapeString(self, string: str) -> str:
         """ Creates a copy of the given string where all double quotation marks 
@@ -98,6 +113,13 @@ class Master_Bot:
                 W += 1
         return (A, D, W)
 
+    def isApproved(self, user: User) -> bool:
+        """ Returns true if enough mods approved the given user for them to be
+            made a contender, and not enough rejected them."""
+        (A, D, _) = self.modResults(user)
+        modRequirements = math.ceil(self.config.get('MOD_ASSIGNMENT')/2)
+        return A >= modRequirements and D < modRequirements
+
     def itemInTable(self, table: str, field: str, value):
         """ Returns true if the given value is in the given table in the given 
             field."""
@@ -365,9 +387,14 @@ class Master_Bot:
     async def queueCommand(self, message: Message):
         sent: Message
         cursor = self.con.cursor()
-        rating: int = cursor.execute(f"""SELECT rating FROM users 
-            WHERE discord_id = {message.author.id}""").fetchone()[0]
+        (rating, steamID) = cursor.execute(f"""SELECT rating, steam_id 
+            FROM users WHERE discord_id = {message.author.id}""").fetchone()
         cursor.close()
+        # the provider only stands in for the mods' rating, not their review,
+        # so users who haven't been approved still can't queue
+        if (rating == None and self.ratingsClient 
+                and self.isApproved(message.author)):
+            rating = await self.ratingsClient.getRating(steamID)
         if rating == None:
             sent = await message.reply(("<@{name}>: the mods haven't assigned "
             "a rating for you yet, so you are unable to queue.").format(
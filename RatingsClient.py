@@ -0,0 +1,60 @@
+from typing import Union
+import time
+import asyncio
+import aiohttp
+
+class RatingsClient:
+
+    def __init__(self, url: str, ttl: float, negativeTTL: float,
+            timeout: float):
+        """ Initializes the instance variables of the RatingsClient class. This
+            includes:
+                url:                the ratings provider endpoint, with a
+                                    {steamID} placeholder for the player
+                ttl:                how many seconds a fetched rating is reused
+                                    before asking the provider again
+                negativeTTL:        how many seconds a missing rating or a
+                                    failed lookup is remembered, so an outage
+                                    doesn't slow down every lookup
+                timeout:            how many seconds to wait on the provider
+                                    before giving up
+                cache:              steam id -> (rating or None, expiry time)"""
+        self.url = url
+        self.ttl = ttl
+        self.negativeTTL = negativeTTL
+        self.timeout = timeout
+        self.cache: dict[int, tuple[Union[int, None], float]] = {}
+
+    async def getRating(self, steamID: int) -> Union[int, None]:
+        """ Returns the rating the provider reports for the given steam id, or
+            None if the provider has no rating for them or could not be
+            reached."""
+        cached = self.cache.get(steamID)
+        if cached and time.time() < cached[1]:
+            return cached[0]
+        rating = await self.fetchRating(steamID)
+        self.cache[steamID] = (rating, time.time() +
+            (self.ttl if rating != None else self.negativeTTL))
+        return rating
+
+    async def fetchRating(self, steamID: int) -> Union[int, None]:
+        """ Asks the provider for the rating of the given steam id. The
+            provider is expected to answer with a JSON object containing a
+            'rating' field. Returns None on any failure."""
+        try:
+            async with aiohttp.ClientSession(timeout = aiohttp.ClientTimeout(
+                    total = self.timeout)) as session:
+                async with session.get(
+                        self.url.format(steamID = steamID)) as response:
+                    if response.status != 200:
+                        print(f"Ratings provider returned {response.status} "
+                            f"for {steamID}")
+                        return None
+                    body = await response.json()
+            if not isinstance(body, dict) or body.get('rating') == None:
+                return None
+            return int(body.get('rating'))
+        except (aiohttp.ClientError, asyncio.TimeoutError, TypeError,
+                ValueError) as error:
+            print(f"Ratings provider failed for {steamID}: {error}")
+            return None
@@ -1,7 +1,7 @@
 from asyncio.events import TimerHandle
 from typing import Callable
 import Master_Bot as MB
-import json
+import Config
 import time
 import itertools
 import math
@@ -37,8 +37,7 @@ class Coordinator:
             directory), and creates instance variables for storing the discord
             info of the users, a queue of the users in FIFO order, and a sorted
             list of all the users by their rating."""
-        with open("config.json") as configFile:
-            self.config: dict = json.load(configFile)
+        self.config: Config.Config = Config.loadConfig()
 
         self.usersByID: dict[int, User] = {}
         self.usersFIFO: list[User] = []
@@ -177,7 +176,8 @@ class Coordinator:
             self.findIndexBS(newUser, self.usersByRating, User.getRating), 
             newUser)
         self.usersByID[discordID] = newUser
-        newUser.eventHandle = self.eventLoop.call_later(90, self.__create)
+        newUser.eventHandle = self.eventLoop.call_later(
+            self.config.get('queueTimeout', 90), self.__create)
         if self.waitingForTen and len(self.usersFIFO) == 10:
             self.waitingForTen = False
             self.__create()
@@ -2,33 +2,187 @@ import fetch from 'node-fetch';
 import sqlite3 from 'sqlite3';
 import express from 'express';
 import net from 'net';
+import http from 'http';
+import https from 'https';
 import { readFileSync } from 'fs';
 
-let config = JSON.parse(readFileSync('./config.json'))
+// Any key in config.json can be overridden by an environment variable named
+// GARGAMEL_ followed by the key in upper case, e.g. GARGAMEL_HTTP_PORT.
+// Values overriding a string are used as-is, values overriding a list may also
+// be comma separated, and anything else must be JSON of the same kind. Keys
+// missing from config.json can't be overridden, since nothing says what type
+// they should have; config.example.json lists every key
+function parseEnvValue(name, envValue, fileValue) {
+    if (typeof fileValue == 'string') {
+        return envValue;
+    }
+    let parsed;
+    try {
+        parsed = JSON.parse(envValue);
+    } catch (error) {
+        if (Array.isArray(fileValue)) {
+            return envValue.split(',').map(item => item.trim()).filter(item => item);
+        }
+        throw new Error(`${name} must be JSON, got ${envValue}`);
+    }
+    if (typeof parsed != typeof fileValue || Array.isArray(parsed) != Array.isArray(fileValue)) {
+        throw new Error(`${name} must be a ${Array.isArray(fileValue) ? 'list' : typeof fileValue} like the value in config.json, got ${envValue}`);
+    }
+    // Discord IDs don't fit in a double, keep those as strings
+    return Number.isInteger(parsed) && !Number.isSafeInteger(parsed) ? envValue : parsed;
+}
+
+const fileConfig = JSON.parse(readFileSync('./config.json'));
+// Check every override now, so a bad value fails at startup
+const envNames = new Map(Object.keys(fileConfig).map(key => [`GARGAMEL_${key.toUpperCase()}`, key]));
+for (const name of Object.keys(process.env)) {
+    if (envNames.has(name)) {
+        parseEnvValue(name, process.env[name], fileConfig[envNames.get(name)]);
+    } else if (name.startsWith('GARGAMEL_')) {
+        console.log(`Ignoring ${name}: there is no matching key in config.json`);
+    }
+}
+let config = new Proxy(fileConfig, {
+    get(target, key) {
+        if (!Object.prototype.hasOwnProperty.call(target, key)) {
+            return undefined;
+        }
+        let name = `GARGAMEL_${String(key).toUpperCase()}`;
+        if (process.env[name] === undefined) {
+            return target[key];
+        }
+        return parseEnvValue(name, process.env[name], target[key]);
+    }
+});
+
+// config.json may hold these lists as JSON lists or comma separated strings
+function asList(value, fallback) {
+    if (value === undefined) {
+        return fallback;
+    } else if (Array.isArray(value)) {
+        return value;
+    }
+    return String(value).split(',').map(item => item.trim()).filter(item => item);
+}
 
 const server = express();
+
+// CORS, so a browser dashboard on another origin can call us. Only origins
+// listed in CORS_ORIGINS get the headers; "*" allows any origin
+const corsOrigins = asList(config.CORS_ORIGINS, []);
+const corsMethods = asList(config.CORS_METHODS, ['GET', 'PUT']);
+const corsHeaders = asList(config.CORS_HEADERS, ['Content-Type']);
+
+server.use((request, response, next) => {
+    let origin = request.get('Origin');
+    if (origin && (corsOrigins.includes('*') || corsOrigins.includes(origin))) {
+        response.set('Access-Control-Allow-Origin', corsOrigins.includes('*') ? '*' : origin);
+        response.set('Vary', 'Origin');
+        if (request.method == 'OPTIONS') {
+            response.set('Access-Control-Allow-Methods', corsMethods.join(', '));
+            response.set('Access-Control-Allow-Headers', corsHeaders.join(', '));
+            return response.sendStatus(204);
+        }
+    }
+    next();
+});
+
+// Token bucket rate limiting, keyed both by client IP and by the Discord access
+// token in the request body, so one client can't hammer the Discord API
+// through us
+const rateLimitPerMinute = config.RATE_LIMIT_PER_MINUTE ?? 30;
+const rateLimitBurst = config.RATE_LIMIT_BURST ?? 10;
+let buckets = new Map();
+
+function takeToken(key) {
+    let now = Date.now();
+    let bucket = buckets.get(key) ?? {tokens: rateLimitBurst, updated: now};
+    bucket.tokens = Math.min(rateLimitBurst, 
+        bucket.tokens + (now - bucket.updated) * rateLimitPerMinute / 60000);
+    bucket.updated = now;
+    buckets.set(key, bucket);
+    if (bucket.tokens < 1) {
+        return Math.ceil((1 - bucket.tokens) * 60 / rateLimitPerMinute);
+    }
+    bucket.tokens -= 1;
+    return 0;
+}
+
+setInterval(() => {
+    for (const [key, bucket] of buckets) {
+        if (Date.now() - bucket.updated > 60000 * rateLimitBurst / rateLimitPerMinute) {
+            buckets.delete(key);
+        }
+    }
+}, 60000).unref();
+
+function rateLimit(key, request, response, next) {
+    let retryAfter = takeToken(key);
+    if (retryAfter > 0) {
+        console.log(`Rate limited ${request.ip}`);
+        response.set('Retry-After', `${retryAfter}`);
+        return sendError(response, 429, 'rate_limited', 'Too many requests, try again later');
+    }
+    next();
+}
+
+// The IP check runs before the body is parsed so malformed or oversized bodies
+// are counted too. Loading the signup page is free, since a single signup
+// already loads it twice around the PUT
+server.use((request, response, next) => {
+    if (request.method == 'GET' && request.path == '/') {
+        return next();
+    }
+    rateLimit(`ip:${request.ip}`, request, response, next);
+});
+
 server.use(express.json());
 
+server.use((request, response, next) => {
+    if (!request.body || !request.body.accessToken) {
+        return next();
+    }
+    rateLimit(`token:${request.body.accessToken}`, request, response, next);
+});
+
 const socketTest = new net.Socket();
 socketTest.connect(config.pipePort, '127.0.0.1', function() {
     console.log('Connected');
 });
 socketTest.destroy()
 
-let db = new sqlite3.Database('allUsers.db');
+let db = new sqlite3.Database(config.DB_PATH ?? 'allUsers.db');
 
 server.get('/', (request, response) => {
     console.log('GET: '+request.url);
     console.log('------------------------------------------');
-    return response.sendFile('index.html', { root: '.' });
+    // The page needs the bot's OAuth client id to build its login link
+    let page = readFileSync('index.html', 'utf8')
+        .replaceAll('{{DISCORD_CLIENT_ID}}', `${config.DISCORD_CLIENT_ID}`);
+    return response.type('html').send(page);
 });
 
+function addToGuild(discordID, accessToken) {
+    fetch(`https://discord.com/api/guilds/${config.GUILD_ID}/members/${discordID}`, {
+        method: 'PUT',
+        body: JSON.stringify({"access_token": `${accessToken}`}),
+        headers: {
+            "access_token": `${accessToken}`, 
+            "Authorization": `Bot ${config.BOT_TOKEN}`, 
+            "Content-Type": 'application/json'
+        }
+    });
+}
+
+function sendError(response, status, code, message, details = null) {
+    response.status(status).send({code: code, message: message, details: details});
+}
+
 server.put('/', (request, response) => {
-    response.status(102)
     console.log('PUT: '+JSON.stringify(request.body));
     let tokenType = request.body.tokenType;
     let accessToken = request.body.accessToken;
-    let discordID = -1;
+    let discordID;
     let steamID = -1;
     console.log('------------------------------------------');
     let result1 = fetch('https://discord.com/api/users/@me', {
@@ -41,9 +195,22 @@ server.put('/', (request, response) => {
         }
     });
     Promise.all([result1, result2]).then( values => {
+        // A 401 means the user's token is bad; anything else (Discord's own
+        // rate limiting, outages) is on Discord's side, not the user's
+        let failed = values.find(value => !value.ok);
+        if (failed) {
+            console.log(`Discord answered ${failed.status} for ${failed.url}`);
+            if (failed.status == 401) {
+                sendError(response, 400, 'invalid_token', 'Discord did not accept the access token');
+            } else {
+                sendError(response, 502, 'discord_unreachable', 'Discord returned an error', 
+                    {status: failed.status});
+            }
+            return;
+        }
         let json1 = values[0].json();
         let json2 = values[1].json();
-        Promise.all([json1, json2]).then( values2 => {
+        return Promise.all([json1, json2]).then( values2 => {
             discordID = values2[0].id;
             console.log('discordID: '+discordID);
             for (const obj in values2[1]) {
@@ -51,39 +218,127 @@ server.put('/', (request, response) => {
                     steamID = values2[1][obj].id;
                     console.log('SteamID: '+steamID);
                 } 
-            } if(discordID == -1){
-                console.log('Big Error: ' + discordID);
-                response.status(400).send({result: 'Big Error'});
+            } if(discordID == undefined){
+                console.log('Big Error: ' + JSON.stringify(values2[0]));
+                sendError(response, 502, 'discord_unreachable', 'Discord returned a user without an id');
             } else if (steamID == -1){
                 response.status(202).send({result: 'No Steam ID'});
             } else {
-                response.status(201).send({result: 'All good!'});
+                // The existence check is part of the INSERT so two signups
+                // racing each other can't both be inserted
                 let command = `INSERT INTO users 
                     (discord_id, steam_id, dateCreated, modsRemaining, timesVouched) 
-                    VALUES (${discordID}, ${steamID}, datetime('now'), ${config.MOD_ASSIGNMENT}, 0)`;
+                    SELECT ${discordID}, ${steamID}, datetime('now'), ${config.MOD_ASSIGNMENT}, 0
+                    WHERE NOT EXISTS (SELECT 1 FROM users WHERE discord_id = ${discordID})`;
                 console.log(command);
-                let socketPipe = new net.Socket();
-                socketPipe.connect(config.pipePort, '127.0.0.1', function() {
-                    socketPipe.write(`${discordID}`);
-                    socketPipe.end()
-                }); 
-                try {
-                    db.exec(command);
-                } catch (error) {
-                    console.log(error)
-                }
-                fetch(`https://discord.com/api/guilds/${config.GUILD_ID}/members/${discordID}`, {
-                    method: 'PUT',
-                    body: JSON.stringify({"access_token": `${accessToken}`}),
-                    headers: {
-                        "access_token": `${accessToken}`, 
-                        "Authorization": `Bot ${config.BOT_TOKEN}`, 
-                        "Content-Type": 'application/json'
+                db.run(command, function(error) {
+                    if (error && error.code == 'SQLITE_CONSTRAINT' || !error && this.changes == 0) {
+                        sendError(response, 409, 'already_registered', 'This Discord account is already registered');
+                    } else if (error) {
+                        console.log(error);
+                        sendError(response, 500, 'database_error', 'Could not register the user');
+                        return;
+                    } else {
+                        response.status(201).send({result: 'All good!'});
+                        let socketPipe = new net.Socket();
+                        socketPipe.on('error', error => console.log(error));
+                        socketPipe.connect(config.pipePort, '127.0.0.1', function() {
+                            socketPipe.write(`${discordID}`);
+                            socketPipe.end()
+                        }); 
                     }
+                    addToGuild(discordID, accessToken);
                 });
             }
         });
+    }).catch(error => {
+        console.log(error);
+        if (!response.headersSent) {
+            sendError(response, 502, 'discord_unreachable', 'Could not reach Discord');
+        }
     });
 });
 
-server.listen(80, () => console.log(`Server listening at http://localhost:80`));
\ No newline at end of file
+server.use((request, response) => {
+    sendError(response, 404, 'not_found', `No route for ${request.method} ${request.path}`);
+});
+
+// Error codes for the body-parser failures express.json() can report
+const bodyErrorCodes = {
+    'entity.parse.failed': 'malformed_body',
+    'entity.too.large': 'body_too_large',
+    'encoding.unsupported': 'unsupported_encoding',
+    'charset.unsupported': 'unsupported_charset',
+    'request.aborted': 'request_aborted',
+    'request.size.invalid': 'body_size_mismatch'
+};
+
+// Errors thrown before or inside the routes, e.g. a malformed JSON body
+// rejected by express.json(), get the same JSON error object as the rest
+server.use((error, request, response, next) => {
+    if (response.headersSent) {
+        console.log(error);
+        return next(error);
+    }
+    let status = error.status ?? 500;
+    if (status < 500) {
+        console.log(`${status} ${error.type ?? ''} from ${request.ip}: ${error.message}`);
+        sendError(response, status, bodyErrorCodes[error.type] ?? 'bad_request', error.message, 
+            {type: error.type ?? null});
+    } else {
+        console.log(error);
+        sendError(response, status, 'internal_error', 'Something went wrong on our end');
+    }
+});
+
+let listeners = [];
+// Unset means every interface
+const listenAddress = config.LISTEN_ADDRESS || undefined;
+const httpPort = config.HTTP_PORT ?? 80;
+if (config.TLS_CERT && config.TLS_KEY) {
+    const tlsOptions = {cert: readFileSync(config.TLS_CERT), key: readFileSync(config.TLS_KEY)};
+    const httpsPort = config.HTTPS_PORT ?? 443;
+    listeners.push(https.createServer(tlsOptions, server).listen(httpsPort, listenAddress, 
+        () => console.log(`Server listening at https://localhost:${httpsPort}`)));
+    // Keep answering on the http port so old links and the http redirect URI
+    // registered with Discord land on the https site instead of failing
+    listeners.push(http.createServer((request, response) => {
+        let hostname;
+        try {
+            hostname = new URL(`http://${request.headers.host}`).hostname;
+        } catch (error) {
+            response.writeHead(400).end();
+            return;
+        }
+        let port = httpsPort == 443 ? '' : `:${httpsPort}`;
+        response.writeHead(301, {Location: `https://${hostname}${port}${request.url}`}).end();
+    }).listen(httpPort, listenAddress, () => console.log(`Redirecting http://localhost:${httpPort} to https`)));
+} else {
+    listeners.push(server.listen(httpPort, listenAddress, 
+        () => console.log(`Server listening at http://localhost:${httpPort}`)));
+}
+
+let shuttingDown = false;
+
+function shutdown() {
+    if (shuttingDown) {
+        return;
+    }
+    shuttingDown = true;
+    console.log('Shutting down');
+    // Give in-flight signups a few seconds to finish, then exit regardless of
+    // any keep-alive sockets still holding a listener open
+    setTimeout(() => process.exit(0), 10000).unref();
+    let open = listeners.length;
+    for (const listener of listeners) {
+        listener.close(() => {
+            open -= 1;
+            if (open == 0) {
+                db.close(error => error && console.log(error));
+            }
+        });
+        listener.closeIdleConnections?.();
+    }
+}
+process.on('SIGTERM', shutdown);
+process.on('SIGINT', shutdown);
\ No newline at end of file